@@ -0,0 +1,305 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// batchFlushSize is the number of posts each worker buffers before flushing
+// them to the database in one go via pq.CopyIn, instead of the one
+// transaction (and one round-trip per tag) that dbInsert used to spend on
+// every single post.
+const batchFlushSize = 200
+
+// tagCache resolves tag names to ids without round-tripping to the database
+// for tags it has already seen. It is shared read-write across all worker
+// goroutines.
+type tagCache struct {
+	mu  sync.RWMutex
+	ids map[string]int
+}
+
+func newTagCache() *tagCache {
+	return &tagCache{ids: make(map[string]int)}
+}
+
+// resolve returns the id of (name, category), inserting it first if
+// necessary. The RETURNING id upsert guarantees an id is returned even when
+// the tag already existed, so a hit and a miss cost the same one query.
+func (tc *tagCache) resolve(tx *sql.Tx, name string, category string) (int, error) {
+	key := category + ":" + name
+	tc.mu.RLock()
+	id, ok := tc.ids[key]
+	tc.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if id, ok := tc.ids[key]; ok {
+		return id, nil
+	}
+	err := tx.QueryRow("INSERT INTO tags(name, category) VALUES ($1, $2) "+
+		"ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING id", name, category).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	tc.ids[key] = id
+	return id, nil
+}
+
+type taggedRow struct {
+	tagId  int
+	postId int
+}
+
+type pairRow struct {
+	first  int
+	postId int
+}
+
+// postBatch buffers posts for a single worker and flushes them to the
+// database in groups of batchFlushSize via bulk COPY statements.
+type postBatch struct {
+	db    *sql.DB
+	tags  *tagCache
+	posts []Post
+}
+
+func newPostBatch(db *sql.DB, tags *tagCache) *postBatch {
+	return &postBatch{db: db, tags: tags}
+}
+
+// add appends a post to the buffer, flushing automatically once it reaches
+// batchFlushSize.
+func (b *postBatch) add(p Post) {
+	b.posts = append(b.posts, p)
+	if len(b.posts) >= batchFlushSize {
+		b.flush()
+	}
+}
+
+// flush writes out whatever is currently buffered, even a short final
+// group. It is safe to call on an empty buffer.
+func (b *postBatch) flush() {
+	if len(b.posts) == 0 {
+		return
+	}
+	if err := bulkInsert(b.db, b.tags, b.posts); err != nil {
+		log.Printf("WARNING Bulk insert failed for a batch of %d posts (%s)", len(b.posts), err)
+	}
+	b.posts = b.posts[:0]
+}
+
+// bulkInsert writes posts, their tags and their favorite/pool relations in
+// a single transaction using pq.CopyIn, replacing the one-row-at-a-time
+// INSERT/SELECT pairs dbInsert and dbInsertTags used to issue per post.
+func bulkInsert(db *sql.DB, tags *tagCache, posts []Post) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := copyInPosts(tx, posts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	tagged, err := resolveTaggedRows(tx, tags, posts)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	taggedPairs := make([]pairRow, len(tagged))
+	for i, t := range tagged {
+		taggedPairs[i] = pairRow{first: t.tagId, postId: t.postId}
+	}
+	if err := copyInPairs(tx, "tagged", taggedPairs); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := copyInPairs(tx, "favorites", favoriteRows(posts)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := copyInPairs(tx, "pooled", pooledRows(posts)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// copyInPosts loads posts into a temporary staging table via pq.CopyIn and
+// then moves them into posts with INSERT ... ON CONFLICT DO NOTHING. A raw
+// COPY straight into posts would abort (and roll back the whole batch) the
+// moment it hit a single post id already in the table, which happens
+// routinely when a resumed scrape overlaps the range it already covered.
+func copyInPosts(tx *sql.Tx, posts []Post) error {
+	if _, err := tx.Exec(`CREATE TEMPORARY TABLE posts_staging
+		(LIKE posts INCLUDING DEFAULTS) ON COMMIT DROP`); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("posts_staging",
+		"id", "created_at", "updated_at", "uploader_id", "score", "source", "md5", "rating",
+		"image_width", "image_height", "file_ext", "parent_id", "has_children", "file_size",
+		"up_score", "down_score", "is_pending", "is_flagged", "is_deleted", "is_banned",
+		"pixiv_id", "bit_flags", "file_url"))
+	if err != nil {
+		return err
+	}
+	for _, p := range posts {
+		_, err := stmt.Exec(p.Id, p.CreatedAt, p.UpdatedAt, p.UploaderId, p.Score, p.Source, p.Md5, p.Rating,
+			p.ImageWidth, p.ImageHeight, p.FileExt, p.ParentId, p.HasChildren, p.FileSize,
+			p.UpScore, p.DownScore, p.IsPending, p.IsFlagged, p.IsDeleted, p.IsBanned,
+			p.PixivId, p.BitFlags, p.FileUrl)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO posts SELECT * FROM posts_staging ON CONFLICT (id) DO NOTHING")
+	return err
+}
+
+// tagFields lists the (tag string, category) pairs a Post carries, mirroring
+// the category constants dbInsert already splits posts into.
+func tagFields(p *Post) []struct {
+	tags     string
+	category string
+} {
+	return []struct {
+		tags     string
+		category string
+	}{
+		{p.TagStringArtist, artist},
+		{p.TagStringCharacter, character},
+		{p.TagStringCopyright, copyright},
+		{p.TagStringGeneral, general},
+	}
+}
+
+func resolveTaggedRows(tx *sql.Tx, tags *tagCache, posts []Post) ([]taggedRow, error) {
+	var rows []taggedRow
+	for i := range posts {
+		p := &posts[i]
+		for _, field := range tagFields(p) {
+			if strings.TrimSpace(field.tags) == "" {
+				continue
+			}
+			for _, name := range strings.Split(field.tags, " ") {
+				if name == "" {
+					continue
+				}
+				id, err := tags.resolve(tx, name, field.category)
+				if err != nil {
+					log.Printf("WARNING Could not resolve tag %s for post %d (%s)", name, p.Id, err)
+					continue
+				}
+				rows = append(rows, taggedRow{tagId: id, postId: p.Id})
+			}
+		}
+	}
+	return rows, nil
+}
+
+func favoriteRows(posts []Post) []pairRow {
+	var rows []pairRow
+	for i := range posts {
+		p := &posts[i]
+		if strings.TrimSpace(p.FavString) == "" {
+			continue
+		}
+		for _, fav := range strings.Split(p.FavString, " ") {
+			userId, err := strconv.Atoi(strings.TrimPrefix(fav, "fav:"))
+			if err == nil {
+				rows = append(rows, pairRow{first: userId, postId: p.Id})
+			}
+		}
+	}
+	return rows
+}
+
+func pooledRows(posts []Post) []pairRow {
+	var rows []pairRow
+	for i := range posts {
+		p := &posts[i]
+		if strings.TrimSpace(p.PoolString) == "" {
+			continue
+		}
+		for _, pool := range strings.Split(p.PoolString, " ") {
+			poolId, err := strconv.Atoi(strings.TrimPrefix(pool, "pool:"))
+			if err == nil {
+				rows = append(rows, pairRow{first: poolId, postId: p.Id})
+			}
+		}
+	}
+	return rows
+}
+
+// copyInPairs bulk-inserts rows into a two-column (x, post_id) table such as
+// tagged, favorites or pooled, via a temporary staging table and
+// INSERT ... ON CONFLICT DO NOTHING. Like copyInPosts, this avoids a raw
+// COPY aborting (and rolling back posts along with it) the moment a
+// resumed or overlapping scrape re-sends a pair that already exists, since
+// these tables all have composite primary keys on (x, post_id).
+func copyInPairs(tx *sql.Tx, table string, rows []pairRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var column string
+	switch table {
+	case "tagged":
+		column = "tag_id"
+	case "favorites":
+		column = "user_id"
+	case "pooled":
+		column = "pool_id"
+	}
+	staging := table + "_staging"
+	if _, err := tx.Exec(fmt.Sprintf(
+		`CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP`, staging, table)); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn(staging, column, "post_id"))
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if _, err := stmt.Exec(r.first, r.postId); err != nil {
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s SELECT * FROM %s ON CONFLICT DO NOTHING", table, staging))
+	return err
+}
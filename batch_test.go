@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "testing"
+
+func TestFavoriteRowsParsesFavStrings(t *testing.T) {
+	posts := []Post{
+		{Id: 1, FavString: "fav:10 fav:20"},
+		{Id: 2, FavString: ""},
+		{Id: 3, FavString: "fav:30"},
+	}
+	rows := favoriteRows(posts)
+	want := []pairRow{{first: 10, postId: 1}, {first: 20, postId: 1}, {first: 30, postId: 3}}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d rows, got %d (%v)", len(want), len(rows), rows)
+	}
+	for i, r := range rows {
+		if r != want[i] {
+			t.Fatalf("row %d: expected %v, got %v", i, want[i], r)
+		}
+	}
+}
+
+func TestPooledRowsParsesPoolStrings(t *testing.T) {
+	posts := []Post{{Id: 7, PoolString: "pool:1 pool:2"}}
+	rows := pooledRows(posts)
+	want := []pairRow{{first: 1, postId: 7}, {first: 2, postId: 7}}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d rows, got %d (%v)", len(want), len(rows), rows)
+	}
+	for i, r := range rows {
+		if r != want[i] {
+			t.Fatalf("row %d: expected %v, got %v", i, want[i], r)
+		}
+	}
+}
+
+func TestTagFieldsListsAllCategories(t *testing.T) {
+	p := &Post{
+		TagStringArtist:    "alice",
+		TagStringCharacter: "bob",
+		TagStringCopyright: "acme",
+		TagStringGeneral:   "1girl solo",
+	}
+	fields := tagFields(p)
+	if len(fields) != 4 {
+		t.Fatalf("expected 4 tag fields, got %d", len(fields))
+	}
+	if fields[0].tags != "alice" || fields[0].category != artist {
+		t.Fatalf("expected artist field first, got %v", fields[0])
+	}
+	if fields[3].tags != "1girl solo" || fields[3].category != general {
+		t.Fatalf("expected general field last, got %v", fields[3])
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const checkpointFilename = ".scrapedbooru_checkpoint.json"
+
+// checkpointState is persisted to disk so an interrupted scrapeRange can
+// resume instead of starting over from startId.
+//
+// Worker goroutines finish batches out of order, so LastCompletedId cannot
+// simply be bumped to whichever batch finishes last: a batch covering
+// [40,60) that finishes before [20,40) must not advance the checkpoint past
+// 20 yet, or a crash right after would make resume skip [20,40) entirely.
+// pending holds finished batches that are still waiting for an earlier one
+// to close the gap; it is not persisted, since on resume there is no
+// in-flight work left to wait for.
+type checkpointState struct {
+	mu              sync.Mutex
+	LastCompletedId int `json:"last_completed_id"`
+	pending         map[int]int
+}
+
+// loadCheckpoint reads the checkpoint file from savePath.
+// A missing file is not an error; it just yields a fresh, empty state.
+func loadCheckpoint(savePath string) (*checkpointState, error) {
+	cp := &checkpointState{}
+	file, err := os.Open(checkpointPath(savePath))
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(cp); err != nil {
+		return cp, err
+	}
+	return cp, nil
+}
+
+// advance records lastId as the new checkpoint if it is further along than
+// the current one and flushes the result to disk.
+func (cp *checkpointState) advance(lastId int, savePath string) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if lastId <= cp.LastCompletedId {
+		return nil
+	}
+	cp.LastCompletedId = lastId
+	return cp.writeLocked(savePath)
+}
+
+// completeRange records that [start,stop) finished and advances
+// LastCompletedId past every contiguous range that is now known to be
+// done, even if [start,stop) itself isn't the one butting up against the
+// current checkpoint. Ranges that arrive ahead of a gap are buffered in
+// pending until the gap is filled.
+func (cp *checkpointState) completeRange(start int, stop int, savePath string) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if stop <= cp.LastCompletedId {
+		return nil
+	}
+	if cp.pending == nil {
+		cp.pending = make(map[int]int)
+	}
+	cp.pending[start] = stop
+	advanced := false
+	for {
+		stop, ok := cp.pending[cp.LastCompletedId]
+		if !ok {
+			break
+		}
+		delete(cp.pending, cp.LastCompletedId)
+		cp.LastCompletedId = stop
+		advanced = true
+	}
+	if !advanced {
+		return nil
+	}
+	return cp.writeLocked(savePath)
+}
+
+// writeLocked flushes cp to the checkpoint file in savePath. Callers must
+// already hold cp.mu.
+func (cp *checkpointState) writeLocked(savePath string) error {
+	file, err := os.Create(checkpointPath(savePath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	return encoder.Encode(cp)
+}
+
+func checkpointPath(savePath string) string {
+	return fmt.Sprintf("%s/%s", savePath, checkpointFilename)
+}
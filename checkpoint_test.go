@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "testing"
+
+func TestCheckpointAdvance(t *testing.T) {
+	dir := t.TempDir()
+	cp := &checkpointState{}
+	if err := cp.advance(10, dir); err != nil {
+		t.Fatalf("advance: %v", err)
+	}
+	if cp.LastCompletedId != 10 {
+		t.Fatalf("expected LastCompletedId 10, got %d", cp.LastCompletedId)
+	}
+	if err := cp.advance(5, dir); err != nil {
+		t.Fatalf("advance: %v", err)
+	}
+	if cp.LastCompletedId != 10 {
+		t.Fatalf("advance must not move backwards, got %d", cp.LastCompletedId)
+	}
+	loaded, err := loadCheckpoint(dir)
+	if err != nil {
+		t.Fatalf("loadCheckpoint: %v", err)
+	}
+	if loaded.LastCompletedId != 10 {
+		t.Fatalf("expected persisted LastCompletedId 10, got %d", loaded.LastCompletedId)
+	}
+}
+
+func TestCheckpointCompleteRangeOutOfOrder(t *testing.T) {
+	dir := t.TempDir()
+	cp := &checkpointState{}
+	// [40,60) finishes before [20,40), so it must be buffered rather than
+	// jumping LastCompletedId ahead of the still-missing [20,40) range.
+	if err := cp.completeRange(40, 60, dir); err != nil {
+		t.Fatalf("completeRange: %v", err)
+	}
+	if cp.LastCompletedId != 0 {
+		t.Fatalf("expected LastCompletedId to stay at 0 while a gap remains, got %d", cp.LastCompletedId)
+	}
+	if err := cp.completeRange(0, 20, dir); err != nil {
+		t.Fatalf("completeRange: %v", err)
+	}
+	if cp.LastCompletedId != 20 {
+		t.Fatalf("expected LastCompletedId 20, got %d", cp.LastCompletedId)
+	}
+	// Filling [20,40) should now close the gap and also absorb the
+	// already-pending [40,60).
+	if err := cp.completeRange(20, 40, dir); err != nil {
+		t.Fatalf("completeRange: %v", err)
+	}
+	if cp.LastCompletedId != 60 {
+		t.Fatalf("expected LastCompletedId 60 after gap closed, got %d", cp.LastCompletedId)
+	}
+	loaded, err := loadCheckpoint(dir)
+	if err != nil {
+		t.Fatalf("loadCheckpoint: %v", err)
+	}
+	if loaded.LastCompletedId != 60 {
+		t.Fatalf("expected persisted LastCompletedId 60, got %d", loaded.LastCompletedId)
+	}
+}
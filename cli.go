@@ -0,0 +1,372 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"log"
+	"os"
+)
+
+// ddlStatements creates the tables scrapeBatch and dbInsert assume already
+// exist. It is split into one statement per table so init-db can report
+// exactly which one failed.
+var ddlStatements = []string{
+	`CREATE TABLE IF NOT EXISTS posts (
+		id INTEGER PRIMARY KEY,
+		created_at TEXT,
+		updated_at TEXT,
+		uploader_id INTEGER,
+		score INTEGER,
+		source TEXT,
+		md5 TEXT,
+		rating TEXT,
+		image_width INTEGER,
+		image_height INTEGER,
+		file_ext TEXT,
+		parent_id INTEGER,
+		has_children BOOLEAN,
+		file_size INTEGER,
+		up_score INTEGER,
+		down_score INTEGER,
+		is_pending BOOLEAN,
+		is_flagged BOOLEAN,
+		is_deleted BOOLEAN,
+		is_banned BOOLEAN,
+		pixiv_id INTEGER,
+		bit_flags BIGINT,
+		file_url TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS tags (
+		id SERIAL PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		category TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS tagged (
+		tag_id INTEGER REFERENCES tags(id),
+		post_id INTEGER REFERENCES posts(id),
+		PRIMARY KEY (tag_id, post_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS favorites (
+		user_id INTEGER,
+		post_id INTEGER REFERENCES posts(id),
+		PRIMARY KEY (user_id, post_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pooled (
+		pool_id INTEGER,
+		post_id INTEGER REFERENCES posts(id),
+		PRIMARY KEY (pool_id, post_id)
+	)`,
+}
+
+func buildApp() *cli.App {
+	return &cli.App{
+		Name:  "scrapedbooru",
+		Usage: "scrape and mirror Danbooru posts",
+		Commands: []*cli.Command{
+			scrapeCommand(),
+			initDbCommand(),
+			resumeCommand(),
+			syncCommand(),
+			exportCommand(),
+			importJsonlCommand(),
+			verifyCommand(),
+		},
+	}
+}
+
+func scrapeCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "scrape",
+		Usage: "scrape a range of post ids or a tag search",
+		Flags: []cli.Flag{
+			&cli.IntFlag{Name: "start", Value: 1, Usage: "first post id to scrape"},
+			&cli.IntFlag{Name: "stop", Value: 1, Usage: "last post id to scrape (exclusive)"},
+			&cli.IntFlag{Name: "threads", Value: 10, Usage: "number of concurrent workers"},
+			&cli.StringFlag{Name: "save-path", Value: ".", Usage: "directory to save downloaded files to"},
+			&cli.StringFlag{Name: "tags", Usage: "Danbooru tag expression to scrape instead of an id range"},
+			&cli.StringFlag{Name: "rating", Usage: "restrict --tags search to a rating (s, q, e)"},
+			&cli.StringFlag{Name: "auth-file", Value: authFilename, Usage: "name of the auth config file in $HOME/" + configDir},
+			&cli.StringFlag{Name: "jsonl-dir", Usage: "also archive every scraped post as gzipped JSONL under this directory"},
+			&cli.IntFlag{Name: "posts-per-jsonl-file", Value: defaultPostsPerJsonlFile, Usage: "how many posts to write per rotated jsonl.gz file"},
+			&cli.BoolFlag{Name: "silent", Usage: "suppress all log output, error messages included"},
+			&cli.BoolFlag{Name: "no-progress", Usage: "disable the progress bar"},
+		},
+		Action: func(c *cli.Context) error {
+			if tags := c.String("tags"); tags != "" {
+				return scrapeTagSearch(tags, c.String("rating"), c.String("save-path"), c.String("auth-file"),
+					c.String("jsonl-dir"), c.Int("posts-per-jsonl-file"), c.Bool("silent"))
+			}
+			scrapeRangeWithAuthFile(c.Int("start"), c.Int("stop"), c.String("save-path"), c.Int("threads"),
+				c.String("auth-file"), c.String("jsonl-dir"), c.Int("posts-per-jsonl-file"),
+				c.Bool("silent"), c.Bool("no-progress"))
+			return nil
+		},
+	}
+}
+
+func initDbCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "init-db",
+		Usage: "create the posts, tags, tagged, favorites and pooled tables",
+		Action: func(c *cli.Context) error {
+			var dbc dbConf
+			if err := parseConfig(dbFilename, &dbc); err != nil {
+				return fmt.Errorf("could not open configuration file: $HOME/%s/%s (%w)", configDir, dbFilename, err)
+			}
+			db, err := openDatabase(&dbc)
+			if err != nil {
+				return fmt.Errorf("could not establish database connection: %w", err)
+			}
+			defer db.Close()
+			for _, stmt := range ddlStatements {
+				if _, err := db.Exec(stmt); err != nil {
+					return fmt.Errorf("could not run DDL statement: %w", err)
+				}
+			}
+			log.Print("Database schema is up to date.")
+			return nil
+		},
+	}
+}
+
+func resumeCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "resume",
+		Usage: "resume a scrape from its checkpoint file up to --stop",
+		Flags: []cli.Flag{
+			&cli.IntFlag{Name: "stop", Required: true, Usage: "last post id to scrape (exclusive)"},
+			&cli.IntFlag{Name: "threads", Value: 10, Usage: "number of concurrent workers"},
+			&cli.StringFlag{Name: "save-path", Value: ".", Usage: "directory holding the checkpoint file"},
+			&cli.BoolFlag{Name: "silent", Usage: "suppress all log output, error messages included"},
+			&cli.BoolFlag{Name: "no-progress", Usage: "disable the progress bar"},
+		},
+		Action: func(c *cli.Context) error {
+			savePath := c.String("save-path")
+			cp, err := loadCheckpoint(savePath)
+			if err != nil {
+				return fmt.Errorf("could not read checkpoint file: %w", err)
+			}
+			scrapeRange(cp.LastCompletedId, c.Int("stop"), savePath, c.Int("threads"),
+				c.Bool("silent"), c.Bool("no-progress"))
+			return nil
+		},
+	}
+}
+
+func importJsonlCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "import-jsonl",
+		Usage: "replay a directory of .jsonl.gz archives written by 'scrape --jsonl-dir' back into Postgres",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "dir", Required: true, Usage: "directory containing the .jsonl.gz archive files"},
+		},
+		Action: func(c *cli.Context) error {
+			var dbc dbConf
+			if err := parseConfig(dbFilename, &dbc); err != nil {
+				return fmt.Errorf("could not open configuration file: $HOME/%s/%s (%w)", configDir, dbFilename, err)
+			}
+			db, err := openDatabase(&dbc)
+			if err != nil {
+				return fmt.Errorf("could not establish database connection: %w", err)
+			}
+			defer db.Close()
+			return importJsonl(c.String("dir"), db)
+		},
+	}
+}
+
+func syncCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "sync",
+		Usage: "incrementally scrape everything newer than the last checkpointed post id",
+		Flags: []cli.Flag{
+			&cli.IntFlag{Name: "since", Usage: "id to start from; defaults to the checkpoint file's last completed id"},
+			&cli.StringFlag{Name: "tags", Usage: "optional additional tag filter to restrict the sync to"},
+			&cli.StringFlag{Name: "save-path", Value: ".", Usage: "directory to save downloaded files to"},
+			&cli.StringFlag{Name: "auth-file", Value: authFilename, Usage: "name of the auth config file in $HOME/" + configDir},
+			&cli.StringFlag{Name: "jsonl-dir", Usage: "also archive every scraped post as gzipped JSONL under this directory"},
+			&cli.IntFlag{Name: "posts-per-jsonl-file", Value: defaultPostsPerJsonlFile, Usage: "how many posts to write per rotated jsonl.gz file"},
+			&cli.BoolFlag{Name: "silent", Usage: "suppress all log output, error messages included"},
+		},
+		Action: func(c *cli.Context) error {
+			return IncrementalScrape(c.Int("since"), c.String("tags"), c.String("save-path"),
+				c.String("auth-file"), c.String("jsonl-dir"), c.Int("posts-per-jsonl-file"), c.Bool("silent"))
+		},
+	}
+}
+
+func verifyCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "verify",
+		Usage: "walk the posts table and re-check the md5 of each downloaded file",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "save-path", Value: ".", Usage: "directory downloaded files were saved to"},
+		},
+		Action: func(c *cli.Context) error {
+			savePath := c.String("save-path")
+			var dbc dbConf
+			if err := parseConfig(dbFilename, &dbc); err != nil {
+				return fmt.Errorf("could not open configuration file: $HOME/%s/%s (%w)", configDir, dbFilename, err)
+			}
+			db, err := openDatabase(&dbc)
+			if err != nil {
+				return fmt.Errorf("could not establish database connection: %w", err)
+			}
+			defer db.Close()
+			storage, err := newStorage(savePath)
+			if err != nil {
+				return fmt.Errorf("could not set up storage backend: %w", err)
+			}
+			rows, err := db.Query("SELECT id, md5, file_ext FROM posts")
+			if err != nil {
+				return fmt.Errorf("could not query posts table: %w", err)
+			}
+			defer rows.Close()
+			var checked, mismatched int
+			for rows.Next() {
+				var id int
+				var md5sum, fileExt string
+				if err := rows.Scan(&id, &md5sum, &fileExt); err != nil {
+					log.Printf("WARNING Could not scan row: %s", err)
+					continue
+				}
+				checked++
+				key := fmt.Sprintf("%d.%s", id, fileExt)
+				if err := verifyStoredMd5(context.Background(), storage, key, md5sum); err != nil {
+					mismatched++
+					log.Printf("WARNING Post %d failed verification: %s", id, err)
+				}
+			}
+			log.Printf("Verified %d posts, %d failed.", checked, mismatched)
+			return nil
+		},
+	}
+}
+
+func exportCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "export",
+		Usage: "dump the posts table as JSON",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "out", Value: "posts.json", Usage: "file to write the exported posts to"},
+		},
+		Action: func(c *cli.Context) error {
+			var dbc dbConf
+			if err := parseConfig(dbFilename, &dbc); err != nil {
+				return fmt.Errorf("could not open configuration file: $HOME/%s/%s (%w)", configDir, dbFilename, err)
+			}
+			db, err := openDatabase(&dbc)
+			if err != nil {
+				return fmt.Errorf("could not establish database connection: %w", err)
+			}
+			defer db.Close()
+			return exportPostsJson(db, c.String("out"))
+		},
+	}
+}
+
+// exportedPost mirrors the columns of the posts table, as opposed to Post
+// which also carries the tag/favorite/pool strings returned by the API.
+type exportedPost struct {
+	Id          int    `json:"id"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	UploaderId  int    `json:"uploader_id"`
+	Score       int    `json:"score"`
+	Source      string `json:"source"`
+	Md5         string `json:"md5"`
+	Rating      string `json:"rating"`
+	ImageWidth  int    `json:"image_width"`
+	ImageHeight int    `json:"image_height"`
+	FileExt     string `json:"file_ext"`
+	ParentId    int    `json:"parent_id"`
+	HasChildren bool   `json:"has_children"`
+	FileSize    int    `json:"file_size"`
+	UpScore     int    `json:"up_score"`
+	DownScore   int    `json:"down_score"`
+	IsPending   bool   `json:"is_pending"`
+	IsFlagged   bool   `json:"is_flagged"`
+	IsDeleted   bool   `json:"is_deleted"`
+	IsBanned    bool   `json:"is_banned"`
+	PixivId     int    `json:"pixiv_id"`
+	BitFlags    int64  `json:"bit_flags"`
+	FileUrl     string `json:"file_url"`
+}
+
+// exportPostsJson writes every row of the posts table to outPath as a
+// single JSON array.
+func exportPostsJson(db *sql.DB, outPath string) error {
+	rows, err := db.Query("SELECT id, created_at, updated_at, uploader_id, score, source, md5, rating, " +
+		"image_width, image_height, file_ext, parent_id, has_children, file_size, up_score, down_score, " +
+		"is_pending, is_flagged, is_deleted, is_banned, pixiv_id, bit_flags, file_url FROM posts")
+	if err != nil {
+		return fmt.Errorf("could not query posts table: %w", err)
+	}
+	defer rows.Close()
+	posts := []exportedPost{}
+	for rows.Next() {
+		var p exportedPost
+		if err := rows.Scan(&p.Id, &p.CreatedAt, &p.UpdatedAt, &p.UploaderId, &p.Score, &p.Source, &p.Md5,
+			&p.Rating, &p.ImageWidth, &p.ImageHeight, &p.FileExt, &p.ParentId, &p.HasChildren, &p.FileSize,
+			&p.UpScore, &p.DownScore, &p.IsPending, &p.IsFlagged, &p.IsDeleted, &p.IsBanned, &p.PixivId,
+			&p.BitFlags, &p.FileUrl); err != nil {
+			return fmt.Errorf("could not scan post row: %w", err)
+		}
+		posts = append(posts, p)
+	}
+	file, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	if err := encoder.Encode(posts); err != nil {
+		return err
+	}
+	log.Printf("Exported %d posts to %s.", len(posts), outPath)
+	return nil
+}
+
+// verifyStoredMd5 recomputes the md5 sum of key as read through storage and
+// compares it against want, returning an error describing the mismatch if
+// any. Reading through Storage instead of assuming a local path means
+// verify works against S3 and HTTP backends the same way scrapeBatch does.
+func verifyStoredMd5(ctx context.Context, storage Storage, key string, want string) error {
+	r, err := storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return err
+	}
+	got := hex.EncodeToString(hash.Sum(nil))
+	if got != want {
+		return fmt.Errorf("md5 mismatch: expected %s, got %s", want, got)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// IncrementalScrape walks forward from lastSeenId, fetching posts newer
+// than it page by page and persisting the new maximum id to the checkpoint
+// file once the walk is done. Calling it again later (e.g. from a cron job)
+// picks up exactly where the previous run left off, turning the scraper
+// into something that can keep a local mirror in sync instead of only
+// doing one-shot bulk downloads. A lastSeenId of 0 starts from the
+// checkpoint file's id instead.
+func IncrementalScrape(lastSeenId int, tags string, savePath string, authFile string, jsonlDir string, postsPerJsonlFile int, silent bool) error {
+	if silent {
+		log.SetOutput(ioutil.Discard)
+	}
+	client, err := newApiClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not set up API client: %w", err)
+	}
+	var auth authDbooru
+	if err := parseConfig(authFile, &auth); err != nil {
+		log.Printf("WARNING Could not open configuration file: $HOME/%s/%s (%s)", configDir, authFile, err)
+		log.Print("WARNING Authentication not possible. Fallback to anonymous user.")
+	}
+	var dbc dbConf
+	if err := parseConfig(dbFilename, &dbc); err != nil {
+		return fmt.Errorf("could not open configuration file: $HOME/%s/%s (%w)", configDir, dbFilename, err)
+	}
+	db, err := openDatabase(&dbc)
+	if err != nil {
+		return fmt.Errorf("could not establish database connection: %w", err)
+	}
+	defer db.Close()
+	storage, err := newStorage(savePath)
+	if err != nil {
+		return fmt.Errorf("could not set up storage backend: %w", err)
+	}
+	cp, err := loadCheckpoint(savePath)
+	if err != nil {
+		log.Printf("WARNING Could not read checkpoint file, starting from %d (%s)", lastSeenId, err)
+		cp = &checkpointState{}
+	} else if lastSeenId == 0 {
+		lastSeenId = cp.LastCompletedId
+	}
+	var sink *jsonlSink
+	if jsonlDir != "" {
+		sink, err = newJsonlSink(jsonlDir, postsPerJsonlFile)
+		if err != nil {
+			return fmt.Errorf("could not set up jsonl archive: %w", err)
+		}
+		defer sink.close()
+	}
+	tc := newTagCache()
+	batch := newPostBatch(db, tc)
+	defer batch.flush()
+	// Danbooru's default sort order for a tag search is id descending, so
+	// page 1 of "id:>N" always returns the newest posts, not the next
+	// oldest-unseen ones. order:id walks forward instead, letting us page
+	// through everything newer than lastSeenId exactly once.
+	query := fmt.Sprintf("id:>%d order:id", lastSeenId)
+	if tags != "" {
+		query = tags + " " + query
+	}
+	maxId := lastSeenId
+	var total int
+	for page := 1; ; page++ {
+		ps, err := requestPostsByTag(query, page, client, &auth)
+		if err != nil {
+			return fmt.Errorf("could not request posts since id %d: %w", maxId, err)
+		}
+		for i := range ps {
+			batch.add(ps[i])
+			if sink != nil {
+				if err := sink.write(&ps[i]); err != nil {
+					log.Printf("WARNING Could not append post %d to jsonl archive: %s", ps[i].Id, err)
+				}
+			}
+			if err := saveFile(&ps[i], storage, client); err != nil {
+				log.Printf("WARNING Saving post failed: %d (%s)", ps[i].Id, err)
+			}
+			if ps[i].Id > maxId {
+				maxId = ps[i].Id
+			}
+		}
+		total += len(ps)
+		if len(ps) < dbooruLimit {
+			break
+		}
+	}
+	batch.flush()
+	if err := cp.advance(maxId, savePath); err != nil {
+		log.Printf("WARNING Could not write checkpoint (%s)", err)
+	}
+	log.Printf("Incremental scrape found %d new posts, now at id %d.", total, maxId)
+	return nil
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultPostsPerJsonlFile = 5000
+
+// jsonlSink appends every post scraped to a rotating, gzip-compressed
+// JSONL archive, a portable copy of the posts (e.g. to feed into an ML
+// pipeline) that importJsonl can replay into Postgres. It runs alongside
+// the database sink, not instead of it: every scrape path still requires
+// a Postgres connection and writes each post there as well.
+type jsonlSink struct {
+	mu           sync.Mutex
+	dir          string
+	postsPerFile int
+	fileIndex    int
+	count        int
+	file         *os.File
+	gz           *gzip.Writer
+	enc          *json.Encoder
+}
+
+// newJsonlSink creates dir if necessary and opens the first archive file.
+// A postsPerFile of 0 uses defaultPostsPerJsonlFile.
+func newJsonlSink(dir string, postsPerFile int) (*jsonlSink, error) {
+	if postsPerFile <= 0 {
+		postsPerFile = defaultPostsPerJsonlFile
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &jsonlSink{dir: dir, postsPerFile: postsPerFile}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonlSink) rotate() error {
+	if s.gz != nil {
+		if err := s.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+	}
+	s.fileIndex++
+	path := filepath.Join(s.dir, fmt.Sprintf("posts-%05d.jsonl.gz", s.fileIndex))
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.gz = gzip.NewWriter(file)
+	s.enc = json.NewEncoder(s.gz)
+	s.count = 0
+	return nil
+}
+
+// write appends p to the current archive file, rotating to a new one first
+// if the current file has reached postsPerFile posts.
+func (s *jsonlSink) write(p *Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count >= s.postsPerFile {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := s.enc.Encode(p); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+func (s *jsonlSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.gz != nil {
+		err = s.gz.Close()
+	}
+	if s.file != nil {
+		if cerr := s.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// importJsonl replays every post archived by jsonlSink in the .jsonl.gz
+// files under dir back into Postgres via dbInsert, so the two formats are
+// interchangeable.
+func importJsonl(dir string, db *sql.DB) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	if err != nil {
+		return err
+	}
+	var total int
+	for _, path := range matches {
+		n, err := importJsonlFile(path, db)
+		if err != nil {
+			return fmt.Errorf("could not import %s: %w", path, err)
+		}
+		total += n
+	}
+	log.Printf("Imported %d posts from %d archive file(s).", total, len(matches))
+	return nil
+}
+
+func importJsonlFile(path string, db *sql.DB) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	decoder := json.NewDecoder(gz)
+	var n int
+	for decoder.More() {
+		var p Post
+		if err := decoder.Decode(&p); err != nil {
+			return n, err
+		}
+		dbInsert(&p, db)
+		n++
+	}
+	return n, nil
+}
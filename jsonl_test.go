@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readJsonlFile decodes a .jsonl.gz archive without touching the database,
+// mirroring the decode half of importJsonlFile so the write/rotate path can
+// be exercised without a live Postgres connection.
+func readJsonlFile(path string) ([]Post, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	decoder := json.NewDecoder(gz)
+	var posts []Post
+	for decoder.More() {
+		var p Post
+		if err := decoder.Decode(&p); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
+
+func TestJsonlSinkRotatesByPostsPerFile(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newJsonlSink(dir, 2)
+	if err != nil {
+		t.Fatalf("newJsonlSink: %v", err)
+	}
+	for id := 1; id <= 5; id++ {
+		if err := sink.write(&Post{Id: id}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := sink.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	// 5 posts at 2 per file rotates into 3 files: [1,2], [3,4], [5].
+	if len(matches) != 3 {
+		t.Fatalf("expected 3 archive files, got %d (%v)", len(matches), matches)
+	}
+}
+
+func TestJsonlSinkWriteReadRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newJsonlSink(dir, 10)
+	if err != nil {
+		t.Fatalf("newJsonlSink: %v", err)
+	}
+	want := []Post{{Id: 1, Md5: "a"}, {Id: 2, Md5: "b"}}
+	for i := range want {
+		if err := sink.write(&want[i]); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := sink.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 archive file, got %d", len(matches))
+	}
+	got, err := readJsonlFile(matches[0])
+	if err != nil {
+		t.Fatalf("readJsonlFile: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d posts, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Id != want[i].Id || got[i].Md5 != want[i].Md5 {
+			t.Fatalf("post %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
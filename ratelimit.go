@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const rateLimitFilename = "ratelimit.json"
+
+// Defaults used when ratelimit.json is absent.
+const (
+	defaultRequestsPerSecond = 10.0
+	defaultBurst             = 10
+	defaultMaxAttempts       = 5
+)
+
+// rateLimitConf is decoded from $HOME/configDir/ratelimit.json.
+type rateLimitConf struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	MaxAttempts       int     `json:"max_attempts"`
+}
+
+// apiClient wraps an *http.Client with a rate limiter, a jittered
+// exponential-backoff retry policy for 429/5xx responses, and a context
+// that cancels in-flight requests as soon as shutdown is requested instead
+// of waiting out clientTimeout.
+type apiClient struct {
+	http        *http.Client
+	limiter     *rate.Limiter
+	maxAttempts int
+	ctx         context.Context
+}
+
+// newApiClient builds an apiClient from ratelimit.json, falling back to
+// conservative defaults if that file does not exist. Requests made through
+// it are bound to ctx, so canceling ctx aborts them immediately.
+func newApiClient(ctx context.Context) (*apiClient, error) {
+	conf := rateLimitConf{
+		RequestsPerSecond: defaultRequestsPerSecond,
+		Burst:             defaultBurst,
+		MaxAttempts:       defaultMaxAttempts,
+	}
+	err := parseConfig(rateLimitFilename, &conf)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read rate limit config: %w", err)
+	}
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = defaultMaxAttempts
+	}
+	return &apiClient{
+		http:        &http.Client{Timeout: clientTimeout},
+		limiter:     rate.NewLimiter(rate.Limit(conf.RequestsPerSecond), conf.Burst),
+		maxAttempts: conf.MaxAttempts,
+		ctx:         ctx,
+	}, nil
+}
+
+// do waits for rate limiter permission and performs req, retrying with
+// jittered exponential backoff (honoring Retry-After when the server sends
+// one) on 429 and 5xx responses, up to maxAttempts times.
+func (c *apiClient) do(req *http.Request) (*http.Response, error) {
+	req = req.WithContext(c.ctx)
+	var lastErr error
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		if err := c.limiter.Wait(c.ctx); err != nil {
+			return nil, err
+		}
+		res, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != 429 && res.StatusCode < 500 {
+			return res, nil
+		}
+		lastErr = errorFromResponse(res)
+		res.Body.Close()
+		wait := retryDelay(res, attempt)
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+func errorFromResponse(res *http.Response) error {
+	return fmt.Errorf("response status indicates failure: %s", res.Status)
+}
+
+// retryDelay honors a server-provided Retry-After header given in seconds;
+// otherwise it backs off exponentially, 2^attempt seconds plus up to one
+// second of random jitter.
+func retryDelay(res *http.Response, attempt int) time.Duration {
+	if ra := res.Header.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	base := time.Duration(math.Pow(2, float64(attempt))) * time.Second
+	return base + time.Duration(rand.Int63n(int64(time.Second)))
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryDelayHonorsRetryAfter(t *testing.T) {
+	res := &http.Response{Header: http.Header{"Retry-After": []string{"3"}}}
+	got := retryDelay(res, 0)
+	if got != 3*time.Second {
+		t.Fatalf("expected 3s, got %s", got)
+	}
+}
+
+func TestRetryDelayBacksOffExponentially(t *testing.T) {
+	res := &http.Response{Header: http.Header{}}
+	for attempt := 0; attempt < 4; attempt++ {
+		d := retryDelay(res, attempt)
+		base := time.Duration(1<<attempt) * time.Second
+		if d < base || d >= base+time.Second {
+			t.Fatalf("attempt %d: expected delay in [%s, %s), got %s", attempt, base, base+time.Second, d)
+		}
+	}
+}
+
+func TestRetryDelayIgnoresUnparseableRetryAfter(t *testing.T) {
+	res := &http.Response{Header: http.Header{"Retry-After": []string{"not-a-number"}}}
+	got := retryDelay(res, 0)
+	if got < time.Second || got >= 2*time.Second {
+		t.Fatalf("expected fallback to exponential backoff for attempt 0, got %s", got)
+	}
+}
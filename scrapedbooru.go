@@ -18,19 +18,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/cheggaaa/pb/v3"
 	_ "github.com/lib/pq"
-	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -105,7 +109,7 @@ type Post struct {
 }
 
 // Don't forget to call res.Body.Close()
-func makeRequest(url string, client *http.Client, auth *authDbooru) (*http.Response, error) {
+func makeRequest(url string, client *apiClient, auth *authDbooru) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -113,7 +117,7 @@ func makeRequest(url string, client *http.Client, auth *authDbooru) (*http.Respo
 	if auth != nil {
 		req.SetBasicAuth(auth.Login, auth.ApiKey)
 	}
-	res, err := client.Do(req)
+	res, err := client.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -242,26 +246,19 @@ func dbInsert(p *Post, db *sql.DB) {
 	tx.Commit() // Actually commit transaction of favorites and pools.
 }
 
-// Save the contents of post.FileUrl in current directory.
-func saveFile(post *Post, path string, client *http.Client) error {
+// Save the contents of post.FileUrl via the given storage backend.
+func saveFile(post *Post, storage Storage, client *apiClient) error {
 	if post.FileUrl == "" {
 		return errors.New("There is no FileUrl field for post: " + strconv.Itoa(post.Id))
 	}
-	file, err := os.Create(fmt.Sprintf("%s/%d.%s", path, post.Id, post.FileExt))
-	if err != nil {
-		return err
-	}
-	defer file.Close()
 	res, err := makeRequest(netloc+post.FileUrl, client, nil)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
-	_, err = io.Copy(file, res.Body)
-	if err != nil {
-		return err
-	}
-	return nil
+	key := fmt.Sprintf("%d.%s", post.Id, post.FileExt)
+	meta := map[string]string{"md5": post.Md5, "rating": post.Rating}
+	return storage.Put(context.Background(), key, res.Body, meta)
 }
 
 // Parse specified JSON file from config directory
@@ -288,7 +285,7 @@ func parseConfig(path string, v interface{}) error {
 // There is a hard limit (from the server) for a limit of 20 posts.
 // Optionally use authentication if account credentials are given.
 // If startId == stopId then just request a single post.
-func requestPost(startId int, stopId int, client *http.Client, auth *authDbooru) []Post {
+func requestPost(startId int, stopId int, client *apiClient, auth *authDbooru) []Post {
 	if stopId-startId > dbooruLimit {
 		log.Fatalf("The hard limit for requesting posts is 20. %d posts actually requested.",
 			stopId-startId)
@@ -342,15 +339,21 @@ func openDatabase(dbc *dbConf) (*sql.DB, error) {
 	return db, err
 }
 
-// Scrape just one batch with a maximum of 20 posts.
-func scrapeBatch(startId int, stopId int, savePath string, client *http.Client, db *sql.DB, auth *authDbooru) {
+// Scrape just one batch with a maximum of 20 posts, buffering posts into
+// batch for a bulk COPY flush instead of inserting them one at a time.
+func scrapeBatch(startId int, stopId int, storage Storage, client *apiClient, auth *authDbooru, batch *postBatch, sink *jsonlSink) {
 	if startId > stopId {
 		log.Fatalf("ERROR Invalid arguments: startId %d has to be smaller than stopId %d", startId, stopId)
 	}
 	ps := requestPost(startId, stopId, client, auth)
 	for i := range ps {
-		dbInsert(&ps[i], db)
-		err := saveFile(&ps[i], savePath, client)
+		batch.add(ps[i])
+		if sink != nil {
+			if err := sink.write(&ps[i]); err != nil {
+				log.Printf("WARNING Could not append post %d to jsonl archive: %s", ps[i].Id, err)
+			}
+		}
+		err := saveFile(&ps[i], storage, client)
 		if err != nil {
 			log.Printf("WARNING Saving post failed: %d (%s)", ps[i].Id, err)
 		}
@@ -363,17 +366,38 @@ type intPair struct {
 }
 
 // This is the big wrapper function called from main()
-func scrapeRange(startId int, stopId int, savePath string, nrThreads int) {
+// It is resumable: if a checkpoint file from a previous, interrupted run is
+// found in savePath, startId is advanced to the last completed id. A
+// SIGINT/SIGTERM stops dispatching new batches, waits for in-flight ones to
+// finish and exits cleanly instead of leaving orphaned goroutines behind.
+func scrapeRange(startId int, stopId int, savePath string, nrThreads int, silent bool, noProgress bool) {
+	scrapeRangeWithAuthFile(startId, stopId, savePath, nrThreads, authFilename, "", 0, silent, noProgress)
+}
+
+// scrapeRangeWithAuthFile is scrapeRange but lets the caller pick which
+// auth config file (relative to $HOME/configDir) to use, so the CLI's
+// --auth-file flag can point at alternate credentials, and optionally also
+// archive every scraped post as gzipped JSONL under jsonlDir.
+func scrapeRangeWithAuthFile(startId int, stopId int, savePath string, nrThreads int, authFile string,
+	jsonlDir string, postsPerJsonlFile int, silent bool, noProgress bool) {
 	if startId > stopId {
 		log.Fatalf("ERROR Invalid arguments: startId %d has to be smaller than stopId %d", startId, stopId)
 	}
-	// Create a client for requests.
-	client := &http.Client{
-		Timeout: clientTimeout,
+	if silent {
+		log.SetOutput(ioutil.Discard)
+	}
+	// Create a rate-limited, retrying client for requests. ctx is canceled
+	// on shutdown so in-flight requests abort immediately instead of
+	// waiting out clientTimeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := newApiClient(ctx)
+	if err != nil {
+		log.Fatalf("ERROR Could not set up API client. (%s)", err)
 	}
 	// Read configurations.
 	var auth authDbooru
-	err := parseConfig(authFilename, &auth)
+	err = parseConfig(authFile, &auth)
 	if err != nil {
 		log.Printf("WARNING Could not open configuration file: $HOME/%s/auth.json (%s)", configDir, err)
 		log.Print("WARNING Authentication not possible. Fallback to anonymous user.")
@@ -388,12 +412,58 @@ func scrapeRange(startId int, stopId int, savePath string, nrThreads int) {
 	if err != nil {
 		log.Fatalf("ERROR Could not establish database connection. (%s)", err)
 	}
+	db.SetMaxOpenConns(nrThreads)
+	db.SetMaxIdleConns(nrThreads)
+	storage, err := newStorage(savePath)
+	if err != nil {
+		log.Fatalf("ERROR Could not set up storage backend. (%s)", err)
+	}
+	var sink *jsonlSink
+	if jsonlDir != "" {
+		sink, err = newJsonlSink(jsonlDir, postsPerJsonlFile)
+		if err != nil {
+			log.Fatalf("ERROR Could not set up jsonl archive. (%s)", err)
+		}
+		defer sink.close()
+	}
+	cp, err := loadCheckpoint(savePath)
+	if err != nil {
+		log.Printf("WARNING Could not read checkpoint file, starting from %d (%s)", startId, err)
+	} else if cp.LastCompletedId > startId {
+		log.Printf("Resuming scrape from checkpointed id %d", cp.LastCompletedId)
+		startId = cp.LastCompletedId
+	}
+	// completeRange only advances from LastCompletedId, so a checkpoint
+	// below startId would never move; start it at startId instead.
+	if cp.LastCompletedId < startId {
+		cp.LastCompletedId = startId
+	}
+	tags := newTagCache()
 	// And now for the scraping itself.
 	// If there is just one post don't use concurrent goroutines.
 	if startId == stopId {
-		scrapeBatch(startId, stopId, savePath, client, db, &auth)
+		batch := newPostBatch(db, tags)
+		scrapeBatch(startId, stopId, storage, client, &auth, batch, sink)
+		batch.flush()
+		if err := cp.advance(stopId, savePath); err != nil {
+			log.Printf("WARNING Could not write checkpoint (%s)", err)
+		}
 		return
 	}
+	var bar *pb.ProgressBar
+	if !silent && !noProgress {
+		bar = pb.StartNew(stopId - startId)
+	}
+	// Stop dispatching new work once a shutdown signal arrives.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	shutdown := make(chan struct{})
+	go func() {
+		<-sigChan
+		log.Print("WARNING Received interrupt, finishing in-flight batches before exiting...")
+		close(shutdown)
+		cancel()
+	}()
 	// <https://stackoverflow.com/questions/25306073/go-always-have-x-number-of-goroutines-running-at-any-time>
 	var paramChannel = make(chan intPair)
 	var waitGroup sync.WaitGroup
@@ -401,28 +471,54 @@ func scrapeRange(startId int, stopId int, savePath string, nrThreads int) {
 	waitGroup.Add(nrThreads)
 	for i := 0; i < nrThreads; i++ {
 		go func() {
+			batch := newPostBatch(db, tags)
+			defer batch.flush()
 			for {
 				params, ok := <-paramChannel
 				if !ok {
 					waitGroup.Done()
 					return
 				}
-				scrapeBatch(params.first, params.second, savePath, client, db, &auth)
+				scrapeBatch(params.first, params.second, storage, client, &auth, batch, sink)
+				if bar != nil {
+					bar.Add(params.second - params.first)
+				}
+				// Requests of a batch running at shutdown may have been
+				// aborted, so such a batch is not recorded as complete.
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := cp.completeRange(params.first, params.second, savePath); err != nil {
+					log.Printf("WARNING Could not write checkpoint (%s)", err)
+				}
 			}
 		}()
 	}
 	// And now add all the parameter pairs to the channel, specifying the jobs.
-	for currentId := startId; currentId < stopId; currentId += dbooruLimit {
-		currentStop := currentId + dbooruLimit
-		if currentStop > stopId {
-			currentStop = stopId
+	// The dispatching goroutine is the sole writer, so it alone closes the
+	// channel, whether it ran out of work or was asked to shut down.
+	go func() {
+		defer close(paramChannel)
+		for currentId := startId; currentId < stopId; currentId += dbooruLimit {
+			currentStop := currentId + dbooruLimit
+			if currentStop > stopId {
+				currentStop = stopId
+			}
+			select {
+			case paramChannel <- intPair{currentId, currentStop}:
+			case <-shutdown:
+				return
+			}
 		}
-		paramChannel <- intPair{currentId, currentStop}
-	}
-	close(paramChannel)
+	}()
 	waitGroup.Wait()
+	if bar != nil {
+		bar.Finish()
+	}
 }
 
 func main() {
-	scrapeRange(1, 1, ".", 10)
+	if err := buildApp().Run(os.Args); err != nil {
+		log.Fatalf("ERROR %s", err)
+	}
 }
@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const storageFilename = "storage.json"
+
+// Storage abstracts where downloaded files end up, so scrapeBatch does not
+// need to care whether it is writing to local disk, S3-compatible object
+// storage or a CDN that accepts plain HTTP PUTs.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, meta map[string]string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// storageConf is decoded from $HOME/configDir/storage.json. Backend selects
+// which of the sections below applies; an absent or missing file falls
+// back to local storage rooted at the --save-path given on the CLI.
+type storageConf struct {
+	Backend string `json:"backend"`
+	Local   struct {
+		Path string `json:"path"`
+	} `json:"local"`
+	S3 struct {
+		Bucket   string `json:"bucket"`
+		Region   string `json:"region"`
+		Endpoint string `json:"endpoint"`
+		Prefix   string `json:"prefix"`
+	} `json:"s3"`
+	Http struct {
+		BaseUrl string            `json:"base_url"`
+		Headers map[string]string `json:"headers"`
+	} `json:"http"`
+}
+
+// newStorage builds the Storage backend configured in storage.json, falling
+// back to local storage rooted at savePath if no such config file exists.
+func newStorage(savePath string) (Storage, error) {
+	var conf storageConf
+	err := parseConfig(storageFilename, &conf)
+	if os.IsNotExist(err) {
+		return &localStorage{basePath: savePath}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read storage config: %w", err)
+	}
+	switch conf.Backend {
+	case "", "local":
+		path := conf.Local.Path
+		if path == "" {
+			path = savePath
+		}
+		return &localStorage{basePath: path}, nil
+	case "s3":
+		return newS3Storage(conf.S3.Bucket, conf.S3.Region, conf.S3.Endpoint, conf.S3.Prefix)
+	case "http":
+		return &httpStorage{
+			baseUrl: conf.Http.BaseUrl,
+			headers: conf.Http.Headers,
+			client:  &http.Client{Timeout: clientTimeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", conf.Backend)
+	}
+}
+
+// localStorage writes files to a directory on the local filesystem. This
+// is the original, and still the default, behavior of saveFile.
+type localStorage struct {
+	basePath string
+}
+
+func (l *localStorage) Put(ctx context.Context, key string, r io.Reader, meta map[string]string) error {
+	file, err := os.Create(fmt.Sprintf("%s/%s", l.basePath, key))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, r)
+	return err
+}
+
+func (l *localStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(fmt.Sprintf("%s/%s", l.basePath, key))
+}
+
+// s3Storage writes files to an S3-compatible bucket, via aws-sdk-go-v2.
+// Setting Endpoint lets this target a MinIO (or other S3-compatible)
+// instance instead of AWS.
+type s3Storage struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Storage(bucket string, region string, endpoint string, prefix string) (*s3Storage, error) {
+	ctx := context.Background()
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load AWS config: %w", err)
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &s3Storage{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, meta map[string]string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(s.prefix + key),
+		Body:     r,
+		Metadata: meta,
+	})
+	return err
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// httpStorage uploads files with a plain HTTP PUT, which is all CDNs like
+// BunnyCDN's storage zones require.
+type httpStorage struct {
+	client  *http.Client
+	baseUrl string
+	headers map[string]string
+}
+
+func (h *httpStorage) Put(ctx context.Context, key string, r io.Reader, meta map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", strings.TrimRight(h.baseUrl, "/")+"/"+key, r)
+	if err != nil {
+		return err
+	}
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range meta {
+		req.Header.Set("X-Meta-"+k, v)
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("storage PUT to %s failed: %s", req.URL, res.Status)
+	}
+	return nil
+}
+
+func (h *httpStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(h.baseUrl, "/")+"/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("storage GET to %s failed: %s", req.URL, res.Status)
+	}
+	return res.Body, nil
+}
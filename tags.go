@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+)
+
+// buildTagQuery combines a free-form tag expression with an optional
+// rating restriction into the query Danbooru expects, e.g.
+// "touhou rating:s".
+func buildTagQuery(tags string, rating string) string {
+	if rating == "" {
+		return tags
+	}
+	return fmt.Sprintf("%s rating:%s", tags, rating)
+}
+
+// scrapeTagSearch walks every page matching tags/rating and stores the
+// posts it finds the same way scrapeBatch does.
+func scrapeTagSearch(tags string, rating string, savePath string, authFile string, jsonlDir string, postsPerJsonlFile int, silent bool) error {
+	if silent {
+		log.SetOutput(ioutil.Discard)
+	}
+	client, err := newApiClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not set up API client: %w", err)
+	}
+	var auth authDbooru
+	if err := parseConfig(authFile, &auth); err != nil {
+		log.Printf("WARNING Could not open configuration file: $HOME/%s/%s (%s)", configDir, authFile, err)
+		log.Print("WARNING Authentication not possible. Fallback to anonymous user.")
+	}
+	var dbc dbConf
+	if err := parseConfig(dbFilename, &dbc); err != nil {
+		return fmt.Errorf("could not open configuration file: $HOME/%s/%s (%w)", configDir, dbFilename, err)
+	}
+	db, err := openDatabase(&dbc)
+	if err != nil {
+		return fmt.Errorf("could not establish database connection: %w", err)
+	}
+	defer db.Close()
+	storage, err := newStorage(savePath)
+	if err != nil {
+		return fmt.Errorf("could not set up storage backend: %w", err)
+	}
+	var sink *jsonlSink
+	if jsonlDir != "" {
+		sink, err = newJsonlSink(jsonlDir, postsPerJsonlFile)
+		if err != nil {
+			return fmt.Errorf("could not set up jsonl archive: %w", err)
+		}
+		defer sink.close()
+	}
+	batch := newPostBatch(db, newTagCache())
+	defer batch.flush()
+	query := buildTagQuery(tags, rating)
+	var total int
+	for page := 1; ; page++ {
+		ps, err := requestPostsByTag(query, page, client, &auth)
+		if err != nil {
+			return fmt.Errorf("could not request page %d for tags %q: %w", page, tags, err)
+		}
+		for i := range ps {
+			batch.add(ps[i])
+			if sink != nil {
+				if err := sink.write(&ps[i]); err != nil {
+					log.Printf("WARNING Could not append post %d to jsonl archive: %s", ps[i].Id, err)
+				}
+			}
+			if err := saveFile(&ps[i], storage, client); err != nil {
+				log.Printf("WARNING Saving post failed: %d (%s)", ps[i].Id, err)
+			}
+		}
+		total += len(ps)
+		if len(ps) < dbooruLimit {
+			break
+		}
+	}
+	batch.flush()
+	log.Printf("Scraped %d posts for tags %q.", total, tags)
+	return nil
+}
+
+// requestPostsByTag queries posts.json with an arbitrary tag expression,
+// optionally paging forward with page. A page of 0 or 1 requests the first
+// page.
+func requestPostsByTag(query string, page int, client *apiClient, auth *authDbooru) ([]Post, error) {
+	reqUrl := fmt.Sprintf("%s/%s?tags=%s&limit=%d", netloc, netpath, url.QueryEscape(query), dbooruLimit)
+	if page > 1 {
+		reqUrl = fmt.Sprintf("%s&page=%d", reqUrl, page)
+	}
+	res, err := makeRequest(reqUrl, client, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var p []Post
+	decoder := json.NewDecoder(res.Body)
+	if err := decoder.Decode(&p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
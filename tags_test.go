@@ -0,0 +1,37 @@
+/*
+ * Copyright (C) 2017 Thomas Leyh
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "testing"
+
+func TestBuildTagQuery(t *testing.T) {
+	cases := []struct {
+		tags   string
+		rating string
+		want   string
+	}{
+		{"touhou", "", "touhou"},
+		{"touhou", "s", "touhou rating:s"},
+		{"", "e", " rating:e"},
+	}
+	for _, c := range cases {
+		if got := buildTagQuery(c.tags, c.rating); got != c.want {
+			t.Errorf("buildTagQuery(%q, %q) = %q, want %q", c.tags, c.rating, got, c.want)
+		}
+	}
+}